@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	v1 "kubevirt.io/client-go/api/v1"
 )
@@ -33,7 +34,18 @@ type (
 	// Type represents allowed config types like ConfigMap or Secret
 	Type string
 
-	isoCreationFunc      func(output string, volID string, files []string) error
+	// Format represents the on-disk filesystem format of a config disk.
+	Format string
+
+	// DatasourceLayout represents where on that filesystem cloud-init (or
+	// an equivalent in-guest agent) expects to find the files.
+	DatasourceLayout string
+
+	// modes carries an optional per-graft-point POSIX permission override
+	// (graft-point name -> mode), as used by projected volume sources that
+	// set ProjectedSource.Mode; entries absent from modes keep the writer's
+	// usual default (0644 for files, 0755 for directories).
+	isoCreationFunc      func(output string, volID string, files []string, modes map[string]uint32) error
 	emptyIsoCreationFunc func(output string, size int64) error
 )
 
@@ -50,8 +62,31 @@ const (
 	// ServiceAccount represents a secret type,
 	// https://kubernetes.io/docs/tasks/configure-pod-container/configure-service-account/
 	ServiceAccount Type = "serviceaccount"
+	// Projected represents a projected volume, merging one disk image out of
+	// several ConfigMap/Secret/DownwardAPI/ServiceAccount sources instead of
+	// giving each its own disk, mirroring Kubernetes' projected volume type:
+	// https://kubernetes.io/docs/concepts/storage/projected-volumes/
+	Projected Type = "projected"
 
 	mountBaseDir = "/var/run/kubevirt-private"
+
+	// ISO9660Format is the default config disk format, read by virtually
+	// every cloud-init/cloudbase-init build.
+	ISO9660Format Format = "iso9660"
+	// VFATFormat formats the disk as a single FAT16/FAT32 filesystem
+	// instead, for guests (small/embedded distros, some cloudbase-init
+	// variants) that prefer a FAT cidata/config-2 disk over an ISO9660 one.
+	VFATFormat Format = "vfat"
+
+	// GenericLayout keeps today's behavior: every source file graft-pointed
+	// at the disk root under its original name.
+	GenericLayout DatasourceLayout = "generic"
+	// NoCloudLayout is cloud-init's NoCloud datasource: user-data,
+	// meta-data and an optional network-config at the disk root.
+	NoCloudLayout DatasourceLayout = "nocloud"
+	// ConfigDriveV2Layout mirrors OpenStack's config-drive v2 datasource,
+	// which cloud-init also understands: files live under openstack/latest/.
+	ConfigDriveV2Layout DatasourceLayout = "configdrive-v2"
 )
 
 var (
@@ -74,6 +109,8 @@ var (
 	ServiceAccountDiskDir = mountBaseDir + "/service-account-disk"
 	// ServiceAccountDiskName represents the name of the ServiceAccount iso image
 	ServiceAccountDiskName = "service-account.iso"
+	// ProjectedDisksDir represents a path to projected volume iso images
+	ProjectedDisksDir = mountBaseDir + "/projected-disks"
 
 	createISOImage      = defaultCreateIsoImage
 	createEmptyISOImage = defaultCreateEmptyIsoImage
@@ -89,6 +126,12 @@ func setEmptyIsoCreationFunction(emptyIsoFunc emptyIsoCreationFunc) {
 	createEmptyISOImage = emptyIsoFunc
 }
 
+// getFilesLayout lists the files directly under dirPath as ISO9660
+// graft-point entries ("name=path"). Every entry is resolved through its
+// symlinks (see resolveUnderRoot) before being included, and one whose final
+// target lies outside dirPath (e.g. at another pod's secret, or a host path
+// bind-mounted into the launcher) is refused instead of silently ending up
+// on the VMI's config disk.
 func getFilesLayout(dirPath string) ([]string, error) {
 	var filesPath []string
 	files, err := ioutil.ReadDir(dirPath)
@@ -97,12 +140,85 @@ func getFilesLayout(dirPath string) ([]string, error) {
 	}
 	for _, file := range files {
 		fileName := file.Name()
-		filesPath = append(filesPath, fileName+"="+filepath.Join(dirPath, fileName))
+		resolved, err := resolveUnderRoot(dirPath, fileName)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to include %q from %q: %w", fileName, dirPath, err)
+		}
+		filesPath = append(filesPath, fileName+"="+resolved.Path)
 	}
 	return filesPath, nil
 }
 
-func defaultCreateIsoImage(output string, volID string, files []string) error {
+// ProjectedSource describes one of the several ConfigMap/Secret/DownwardAPI/
+// ServiceAccount mounts that make up a single projected volume's disk. Each
+// source keeps its own SourceDir (virt-handler mounts them separately, the
+// same way it already does for the non-projected types) and is grafted
+// under SubPath on the merged disk, matching how Kubernetes' own projected
+// volumes let each source pick a subdirectory of the combined mount.
+type ProjectedSource struct {
+	// Name is a label for this source, e.g. "configmap/foo"; it is never
+	// written to the disk itself, and VolumeStatus size lookups do not use
+	// it (findIsoSize keys them by volume name and source index).
+	Name      string
+	SourceDir string
+	SubPath   string
+	// Mode is the optional POSIX permission override for this source's
+	// files; nil keeps the writer's usual default.
+	Mode *int32
+}
+
+// getProjectedFilesLayout merges the per-source directories of a projected
+// volume into one graft-point list ("subdir/file=/path/on/host"), exactly
+// like getFilesLayout but rooted at several independent directories instead
+// of one. Every file is still resolved component-by-component under its own
+// source's root, so one source's symlink can't be used to escape into
+// another source's directory, let alone outside the pod's mounts entirely.
+func getProjectedFilesLayout(sources []ProjectedSource) ([]string, map[string]uint32, error) {
+	var filesPath []string
+	modes := map[string]uint32{}
+	for _, src := range sources {
+		files, err := ioutil.ReadDir(src.SourceDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range files {
+			fileName := file.Name()
+			resolved, err := resolveUnderRoot(src.SourceDir, fileName)
+			if err != nil {
+				return nil, nil, fmt.Errorf("refusing to include %q from %q: %w", fileName, src.SourceDir, err)
+			}
+			graftName := fileName
+			if src.SubPath != "" {
+				graftName = filepath.Join(src.SubPath, fileName)
+			}
+			filesPath = append(filesPath, graftName+"="+resolved.Path)
+			if src.Mode != nil {
+				modes[graftName] = uint32(*src.Mode)
+			}
+		}
+	}
+	return filesPath, modes, nil
+}
+
+// isoBackendEnvVar selects the ISO9660 writer backend. The default, native
+// Go writer removes the dependency on the xorrisofs binary from every
+// virt-handler/virt-launcher image; setting this to "xorrisofs" restores
+// the previous shell-out behavior byte-for-byte, for deployments that rely
+// on some xorrisofs-specific quirk.
+const isoBackendEnvVar = "KUBEVIRT_ISO_BACKEND"
+
+func defaultCreateIsoImage(output string, volID string, files []string, modes map[string]uint32) error {
+	if os.Getenv(isoBackendEnvVar) == "xorrisofs" {
+		return xorrisofsCreateIsoImage(output, volID, files, modes)
+	}
+	return nativeCreateIsoImage(output, volID, files, modes)
+}
+
+// xorrisofsCreateIsoImage shells out to xorrisofs. It has no equivalent of
+// per-source mode bits short of writing out a Rock Ridge rules file, which
+// isn't worth the complexity for a compatibility fallback; modes is only
+// honored by the native writer.
+func xorrisofsCreateIsoImage(output string, volID string, files []string, modes map[string]uint32) error {
 
 	if volID == "" {
 		volID = "cfgdata"
@@ -125,9 +241,9 @@ func defaultCreateIsoImage(output string, volID string, files []string) error {
 
 	// #nosec No risk for attacket injection. Parameters are predefined strings
 	cmd := exec.Command(isoBinary, args...)
-	err := cmd.Run()
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return err
+		return fmt.Errorf("%s failed: %v: %s", isoBinary, err, out)
 	}
 	return nil
 }
@@ -145,27 +261,155 @@ func defaultCreateEmptyIsoImage(output string, size int64) error {
 	return nil
 }
 
-func createIsoConfigImage(output string, volID string, files []string, size int64) error {
-	var err error
-	if size == 0 {
-		err = createISOImage(output, volID, files)
-	} else {
-		err = createEmptyISOImage(output, size)
+// ConfigDiskSpec describes everything needed to build one config disk: its
+// content, its on-disk Format, and the DatasourceLayout the guest's
+// cloud-init implementation expects that content arranged in. Content comes
+// from exactly one of Files (a single source, already graft-point encoded
+// by getFilesLayout) or Sources (several sources merged for a Projected
+// volume); if both are set, Sources wins and Files is ignored.
+type ConfigDiskSpec struct {
+	Output  string
+	VolID   string
+	Files   []string
+	Sources []ProjectedSource
+	Size    int64
+	Format  Format
+	Layout  DatasourceLayout
+}
+
+// applyDatasourceLayout rewrites graft-point names ("name=path") to match
+// the directory structure a given cloud-init datasource expects to find on
+// the disk. GenericLayout and NoCloudLayout both keep files at the disk
+// root (NoCloud's user-data/meta-data/network-config are already the names
+// produced upstream of here); ConfigDriveV2Layout nests them.
+func applyDatasourceLayout(layout DatasourceLayout, files []string) []string {
+	if layout != ConfigDriveV2Layout {
+		return files
 	}
-	if err != nil {
-		return err
+	out := make([]string, 0, len(files))
+	for _, entry := range files {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			out = append(out, entry)
+			continue
+		}
+		out = append(out, "openstack/latest/"+parts[0]+"="+parts[1])
 	}
-	return nil
+	return out
+}
+
+func createIsoConfigImage(spec ConfigDiskSpec) error {
+	format := spec.Format
+	if format == "" {
+		format = ISO9660Format
+	}
+	layout := spec.Layout
+	if layout == "" {
+		layout = GenericLayout
+	}
+
+	if spec.Size != 0 {
+		// A placeholder disk of a known size, to be populated on a later
+		// call once the real content is available; the eventual format
+		// doesn't matter until then.
+		return createEmptyISOImage(spec.Output, spec.Size)
+	}
+
+	files, modes := spec.Files, map[string]uint32(nil)
+	if len(spec.Sources) > 0 {
+		var err error
+		files, modes, err = getProjectedFilesLayout(spec.Sources)
+		if err != nil {
+			return err
+		}
+	}
+	files = applyDatasourceLayout(layout, files)
+	if layout == ConfigDriveV2Layout && len(modes) > 0 {
+		// Keep the mode overrides keyed by the renamed graft points.
+		nested := make(map[string]uint32, len(modes))
+		for name, mode := range modes {
+			nested["openstack/latest/"+name] = mode
+		}
+		modes = nested
+	}
+	if format == VFATFormat {
+		// The FAT writer has no notion of POSIX permission bits; modes is
+		// silently ignored here the same way it is for directories on ISO.
+		return nativeCreateVfatImage(spec.Output, spec.VolID, files)
+	}
+	return createISOImage(spec.Output, spec.VolID, files, modes)
+}
+
+// VolumeConfigFormat reads the opt-in Format/DatasourceLayout chosen on a
+// ConfigMap/Secret volume via the string-typed `Format`/`DatasourceLayout`
+// fields on v1.ConfigMapVolumeSource/v1.SecretVolumeSource, defaulting to
+// today's ISO9660+generic behavior when unset.
+func VolumeConfigFormat(volume *v1.Volume) (Format, DatasourceLayout) {
+	switch {
+	case volume.ConfigMap != nil:
+		return formatOrDefault(Format(volume.ConfigMap.Format)), layoutOrDefault(DatasourceLayout(volume.ConfigMap.DatasourceLayout))
+	case volume.Secret != nil:
+		return formatOrDefault(Format(volume.Secret.Format)), layoutOrDefault(DatasourceLayout(volume.Secret.DatasourceLayout))
+	}
+	return ISO9660Format, GenericLayout
+}
+
+func formatOrDefault(f Format) Format {
+	if f == "" {
+		return ISO9660Format
+	}
+	return f
+}
+
+func layoutOrDefault(l DatasourceLayout) DatasourceLayout {
+	if l == "" {
+		return GenericLayout
+	}
+	return l
+}
+
+// projectedSourceStatusNames returns the synthetic VolumeStatus names under
+// which each of a Projected volume's sources reports its own size, since a
+// single v1.VolumeStatus entry (keyed by volume.Name) can't carry more than
+// one size. Built from the `Projected *ProjectedVolumeSource` field on
+// v1.Volume, keyed by each source's index within Sources.
+func projectedSourceStatusNames(volume *v1.Volume) []string {
+	if volume.Projected == nil {
+		return nil
+	}
+	names := make([]string, 0, len(volume.Projected.Sources))
+	for i := range volume.Projected.Sources {
+		names = append(names, fmt.Sprintf("%s/%d", volume.Name, i))
+	}
+	return names
 }
 
 func findIsoSize(vmi *v1.VirtualMachineInstance, volume *v1.Volume, emptyIso bool) (int64, error) {
-	if emptyIso {
+	if !emptyIso {
+		return 0, nil
+	}
+
+	if sourceNames := projectedSourceStatusNames(volume); sourceNames != nil {
+		var total int64
+		found := 0
 		for _, vs := range vmi.Status.VolumeStatus {
-			if vs.Name == volume.Name {
-				return vs.Size, nil
+			for _, name := range sourceNames {
+				if vs.Name == name {
+					total += vs.Size
+					found++
+				}
 			}
 		}
-		return 0, fmt.Errorf("failed to find the status of volume %s", volume.Name)
+		if found != len(sourceNames) {
+			return 0, fmt.Errorf("failed to find the status of all sources of projected volume %s", volume.Name)
+		}
+		return total, nil
+	}
+
+	for _, vs := range vmi.Status.VolumeStatus {
+		if vs.Name == volume.Name {
+			return vs.Size, nil
+		}
 	}
-	return 0, nil
+	return 0, fmt.Errorf("failed to find the status of volume %s", volume.Name)
 }
@@ -0,0 +1,253 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	fatBytesPerSector = 512
+	fatDirEntrySize   = 32
+	fatRootEntries    = 512 // FAT16 only; FAT32 root lives in the cluster area
+	fat16MaxClusters  = 65524
+	fat16MinClusters  = 4085 // below this a FAT16 volume is misidentified as FAT12
+)
+
+// fatNode mirrors isoNode for the much simpler FAT8.3 case: no Joliet, no
+// Rock Ridge, just short names and a cluster chain per file/directory.
+type fatNode struct {
+	name     string
+	short    [11]byte
+	isDir    bool
+	resolved *resolvedSource
+	size     uint32
+	parent   *fatNode
+	children []*fatNode
+
+	firstCluster uint32
+}
+
+func buildFatTree(files []string) (*fatNode, error) {
+	root := &fatNode{isDir: true}
+	for _, entry := range files {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, &isoBuildError{file: entry, op: "parse graft point", err: fmt.Errorf("expected NAME=PATH")}
+		}
+		graftName, source := parts[0], parts[1]
+
+		resolved, err := resolveUnderRoot(filepath.Dir(source), filepath.Base(source))
+		if err != nil {
+			return nil, &isoBuildError{file: source, op: "resolve", err: err}
+		}
+
+		segments := strings.Split(strings.Trim(graftName, "/"), "/")
+		dir := root
+		for _, seg := range segments[:len(segments)-1] {
+			dir = dir.childDir(seg)
+		}
+		leafName := segments[len(segments)-1]
+		if dir.find(leafName) != nil {
+			return nil, &isoBuildError{file: graftName, op: "build layout", err: fmt.Errorf("duplicate entry")}
+		}
+		dir.children = append(dir.children, &fatNode{
+			name:     leafName,
+			resolved: resolved,
+			size:     uint32(resolved.Size),
+			parent:   dir,
+		})
+	}
+	if err := assignFatNames(root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (n *fatNode) find(name string) *fatNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *fatNode) childDir(name string) *fatNode {
+	if existing := n.find(name); existing != nil {
+		return existing
+	}
+	d := &fatNode{name: name, isDir: true, parent: n}
+	n.children = append(n.children, d)
+	return d
+}
+
+func assignFatNames(n *fatNode) error {
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+	used := map[[11]byte]bool{}
+	for _, c := range n.children {
+		short, err := shortenFatName(c.name)
+		if err != nil {
+			return &isoBuildError{file: c.name, op: "shorten name", err: err}
+		}
+		for i := 1; used[short]; i++ {
+			short = fat83Collision(short, i)
+		}
+		used[short] = true
+		c.short = short
+		if c.isDir {
+			if err := assignFatNames(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shortenFatName renders an arbitrary name as an 11-byte, space-padded,
+// upper-case 8.3 FAT short name (8 bytes base + 3 bytes extension, no dot).
+func shortenFatName(name string) ([11]byte, error) {
+	var out [11]byte
+	for i := range out {
+		out[i] = ' '
+	}
+
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+				b.WriteRune(r)
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base = clean(base)
+	ext = clean(ext)
+	if base == "" {
+		return out, fmt.Errorf("empty file name")
+	}
+	if len(base) > 8 {
+		base = base[:8]
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	copy(out[0:8], base)
+	copy(out[8:11], ext)
+	return out, nil
+}
+
+func fat83Collision(short [11]byte, i int) [11]byte {
+	suffix := fmt.Sprintf("~%d", i)
+	base := strings.TrimRight(string(short[0:8]), " ")
+	if len(base) > 8-len(suffix) {
+		base = base[:8-len(suffix)]
+	}
+	var out [11]byte
+	for i := range out {
+		out[i] = ' '
+	}
+	copy(out[0:8], base+suffix)
+	copy(out[8:11], short[8:11])
+	return out
+}
+
+// fatGeometry picks FAT16 vs FAT32 and a cluster size, given the amount of
+// data (files + directory extents) that needs to fit. FAT16 is preferred
+// (broader guest compatibility) and used whenever some cluster size puts
+// the real cluster count in its addressing range; below that range (the
+// overwhelmingly common case - any ConfigMap/Secret/cidata payload under a
+// couple MiB) the smallest cluster size is still used for FAT16, and
+// fatWriter.layout pads the volume's free space out to fat16MinClusters so
+// the on-disk cluster count actually matches what the boot sector claims.
+// FAT32 only kicks in once the data no longer fits FAT16 even at the
+// largest cluster size.
+func fatGeometry(dataBytes int64) (fat32 bool, sectorsPerCluster int) {
+	for _, spc := range []int{1, 2, 4, 8, 16, 32, 64} {
+		clusterBytes := int64(spc * fatBytesPerSector)
+		clusters := (dataBytes + clusterBytes - 1) / clusterBytes
+		if clusters < fat16MinClusters {
+			return false, 1
+		}
+		if clusters < fat16MaxClusters {
+			return false, spc
+		}
+	}
+	return true, 8
+}
+
+// nativeCreateVfatImage builds a raw FAT16/FAT32 disk image in-process (no
+// mkfs.vfat dependency), with one directory entry per file/subdirectory
+// produced by buildFatTree.
+func nativeCreateVfatImage(output string, volID string, files []string) error {
+	if volID == "" {
+		volID = "CIDATA"
+	}
+
+	root, err := buildFatTree(files)
+	if err != nil {
+		return err
+	}
+
+	var totalFileBytes int64
+	var walk func(n *fatNode)
+	walk = func(n *fatNode) {
+		for _, c := range n.children {
+			if c.isDir {
+				totalFileBytes += fatRootEntries * fatDirEntrySize // rough per-dir overhead
+				walk(c)
+			} else {
+				totalFileBytes += int64(c.size)
+			}
+		}
+	}
+	walk(root)
+
+	fat32, spc := fatGeometry(totalFileBytes + 1<<20) // +1MiB headroom for metadata/slack
+	clusterSize := spc * fatBytesPerSector
+
+	fw := &fatWriter{fat32: fat32, sectorsPerCluster: spc, clusterSize: clusterSize, volID: volID}
+	if err := fw.layout(root); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return &isoBuildError{file: output, op: "create", err: err}
+	}
+	defer f.Close()
+
+	if err := f.Truncate(int64(fw.totalSectors) * fatBytesPerSector); err != nil {
+		return &isoBuildError{file: output, op: "truncate", err: err}
+	}
+	return fw.write(f, root)
+}
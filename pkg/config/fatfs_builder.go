@@ -0,0 +1,403 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatEOC16         = 0xFFFF
+	fatEOC32         = 0x0FFFFFFF
+	fatNumFATs       = 2
+)
+
+func le16(v uint16) []byte { return []byte{byte(v), byte(v >> 8)} }
+func le32(v uint32) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)} }
+
+func fatDate(t time.Time) uint16 {
+	y := t.Year() - 1980
+	if y < 0 {
+		y = 0
+	}
+	return uint16(y<<9 | int(t.Month())<<5 | t.Day())
+}
+
+func fatTime(t time.Time) uint16 {
+	return uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+}
+
+// fatWriter lays out a FAT16/FAT32 volume: boot sector, two FAT copies, a
+// (FAT16 only) fixed root directory area, and a data region holding every
+// other directory's entries plus file content, one contiguous cluster run
+// per node to keep the FAT chains trivial to build.
+type fatWriter struct {
+	fat32             bool
+	sectorsPerCluster int
+	clusterSize       int
+	volID             string
+	when              time.Time
+
+	reservedSectors uint32
+	fatSizeSectors  uint32
+	rootDirSectors  uint32
+	firstDataSector uint32
+	totalSectors    uint32
+	totalClusters   uint32
+
+	fat []uint32
+
+	rootDirBytes []byte            // FAT16 fixed root area content
+	dirBytes     map[*fatNode][]byte
+}
+
+func (fw *fatWriter) layout(root *fatNode) error {
+	fw.when = time.Now()
+	fw.reservedSectors = 1
+	if fw.fat32 {
+		fw.reservedSectors = 32
+	}
+
+	// Pass 1: how many clusters does every node need?
+	var nextCluster uint32 = 2
+	var assign func(n *fatNode, isRoot bool)
+	assign = func(n *fatNode, isRoot bool) {
+		if isRoot && !fw.fat32 {
+			// FAT16 root lives in the fixed root area, not the cluster heap.
+		} else {
+			n.firstCluster = nextCluster
+			nextCluster += fatDirClusters(n, isRoot, fw.clusterSize)
+		}
+		for _, c := range n.children {
+			if c.isDir {
+				assign(c, false)
+				continue
+			}
+			if c.size == 0 {
+				c.firstCluster = 0
+				continue
+			}
+			c.firstCluster = nextCluster
+			nextCluster += fatClustersFor(c.size, fw.clusterSize)
+		}
+	}
+	assign(root, true)
+	fw.totalClusters = nextCluster - 2
+	if !fw.fat32 && fw.totalClusters < fat16MinClusters {
+		// The real file set needs far fewer clusters than FAT16's minimum
+		// addressable count; pad the volume with unused free clusters
+		// (FAT entry 0 = free, already the zero value) rather than
+		// misreporting a FAT32 volume that doesn't meet FAT32's own
+		// 65525-cluster minimum.
+		fw.totalClusters = fat16MinClusters
+	}
+
+	fw.fatSizeSectors = fatTableSectors(fw.totalClusters+2, fw.fat32)
+	if !fw.fat32 {
+		fw.rootDirSectors = fatClustersFor(fatRootEntries*fatDirEntrySize, fatBytesPerSector) * 1
+	}
+	fw.firstDataSector = fw.reservedSectors + fatNumFATs*fw.fatSizeSectors + fw.rootDirSectors
+	fw.totalSectors = fw.firstDataSector + fw.totalClusters*uint32(fw.sectorsPerCluster)
+
+	// Pass 2: build the FAT chain entries and every directory's byte content.
+	fw.fat = make([]uint32, fw.totalClusters+2)
+	fw.dirBytes = map[*fatNode][]byte{}
+
+	var link func(n *fatNode, isRoot bool)
+	link = func(n *fatNode, isRoot bool) {
+		if !(isRoot && !fw.fat32) {
+			fw.chain(n.firstCluster, fatDirClusters(n, isRoot, fw.clusterSize))
+		}
+		entries := fw.renderDirEntries(n, isRoot)
+		if isRoot && !fw.fat32 {
+			fw.rootDirBytes = entries
+		} else {
+			fw.dirBytes[n] = entries
+		}
+		for _, c := range n.children {
+			if c.isDir {
+				link(c, false)
+				continue
+			}
+			if c.size == 0 {
+				continue
+			}
+			fw.chain(c.firstCluster, fatClustersFor(c.size, fw.clusterSize))
+		}
+	}
+	link(root, true)
+
+	return nil
+}
+
+// fatDirClusters is how many clusters a directory's own entries occupy.
+// Every directory gets at least one, even an empty FAT32 root, since a
+// directory can never have a zero-length extent on FAT.
+func fatDirClusters(n *fatNode, isRoot bool, clusterSize int) uint32 {
+	entries := len(n.children)
+	if !isRoot {
+		entries += 2 // "." and ".."
+	}
+	clusters := fatClustersFor(uint32(entries*fatDirEntrySize), clusterSize)
+	if clusters == 0 {
+		clusters = 1
+	}
+	return clusters
+}
+
+// chain marks `count` consecutive clusters starting at `start` as a single
+// chain, terminated with the end-of-chain marker.
+func (fw *fatWriter) chain(start, count uint32) {
+	if count == 0 {
+		return
+	}
+	eoc := uint32(fatEOC16)
+	if fw.fat32 {
+		eoc = fatEOC32
+	}
+	for i := uint32(0); i < count-1; i++ {
+		fw.fat[start+i] = start + i + 1
+	}
+	fw.fat[start+count-1] = eoc
+}
+
+// renderDirEntries builds the 32-byte records for a directory's children,
+// plus "." / ".." for anything other than the volume root.
+func (fw *fatWriter) renderDirEntries(n *fatNode, isRoot bool) []byte {
+	var out []byte
+	if !isRoot {
+		out = append(out, fw.dirEntry([11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, n.firstCluster, 0, true)...)
+		// n.parent.firstCluster is 0 for the FAT16 root (which has no
+		// cluster number of its own), and the real cluster for the FAT32
+		// root or any other parent - exactly what ".." should point to.
+		out = append(out, fw.dirEntry([11]byte{'.', '.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, n.parent.firstCluster, 0, true)...)
+	}
+	for _, c := range n.children {
+		out = append(out, fw.dirEntry(c.short, c.firstCluster, c.size, c.isDir)...)
+	}
+	return out
+}
+
+func (fw *fatWriter) dirEntry(short [11]byte, cluster, size uint32, isDir bool) []byte {
+	e := make([]byte, fatDirEntrySize)
+	copy(e[0:11], short[:])
+	if isDir {
+		e[11] = fatAttrDirectory
+	} else {
+		e[11] = fatAttrArchive
+	}
+	copy(e[14:16], le16(fatTime(fw.when)))
+	copy(e[16:18], le16(fatDate(fw.when)))
+	copy(e[18:20], le16(fatDate(fw.when)))
+	copy(e[20:22], le16(uint16(cluster>>16)))
+	copy(e[22:24], le16(fatTime(fw.when)))
+	copy(e[24:26], le16(fatDate(fw.when)))
+	copy(e[26:28], le16(uint16(cluster)))
+	copy(e[28:32], le32(size))
+	return e
+}
+
+func fatClustersFor(size uint32, clusterSize int) uint32 {
+	if size == 0 {
+		return 0
+	}
+	return (size + uint32(clusterSize) - 1) / uint32(clusterSize)
+}
+
+// fatTableSectors computes how many sectors one copy of the FAT needs to
+// hold `entries` table slots.
+func fatTableSectors(entries uint32, fat32 bool) uint32 {
+	entrySize := uint32(2)
+	if fat32 {
+		entrySize = 4
+	}
+	bytes := entries * entrySize
+	return (bytes + fatBytesPerSector - 1) / fatBytesPerSector
+}
+
+func (fw *fatWriter) bootSector() []byte {
+	b := make([]byte, fatBytesPerSector)
+	b[0], b[1], b[2] = 0xEB, 0x3C, 0x90
+	copy(b[3:11], "KUBEVIRT")
+	copy(b[11:13], le16(fatBytesPerSector))
+	b[13] = byte(fw.sectorsPerCluster)
+	copy(b[14:16], le16(uint16(fw.reservedSectors)))
+	b[16] = fatNumFATs
+	b[21] = 0xF8 // media: fixed disk
+
+	totalSec16 := uint16(0)
+	if fw.totalSectors <= 0xFFFF {
+		totalSec16 = uint16(fw.totalSectors)
+	}
+	copy(b[19:21], le16(totalSec16))
+	copy(b[32:36], le32(fw.totalSectors))
+	copy(b[24:26], le16(32)) // sectors per track (dummy CHS geometry)
+	copy(b[26:28], le16(64)) // heads
+
+	if !fw.fat32 {
+		copy(b[17:19], le16(fatRootEntries))
+		copy(b[22:24], le16(uint16(fw.fatSizeSectors)))
+		b[36] = 0x80
+		b[38] = 0x29
+		copy(b[39:43], le32(0x12345678))
+		copy(b[43:54], padBytes(fw.volID, 11))
+		copy(b[54:62], padBytes("FAT16", 8))
+	} else {
+		copy(b[36:40], le32(fw.fatSizeSectors))
+		copy(b[44:48], le32(2)) // root cluster
+		copy(b[48:50], le16(1)) // FSInfo sector
+		copy(b[50:52], le16(6)) // backup boot sector
+		b[64] = 0x80
+		b[66] = 0x29
+		copy(b[67:71], le32(0x12345678))
+		copy(b[71:82], padBytes(fw.volID, 11))
+		copy(b[82:90], padBytes("FAT32", 8))
+	}
+
+	b[510], b[511] = 0x55, 0xAA
+	return b
+}
+
+func (fw *fatWriter) fatTableBytes() []byte {
+	entrySize := 2
+	if fw.fat32 {
+		entrySize = 4
+	}
+	out := make([]byte, int(fw.fatSizeSectors)*fatBytesPerSector)
+	// Entries 0/1 are reserved: entry 0 mirrors the media descriptor, entry
+	// 1 carries the end-of-chain/clean-shutdown flags.
+	media := uint32(0xFFFFFF00 | 0xF8)
+	if fw.fat32 {
+		media = 0x0FFFFF00 | 0xF8
+	}
+	writeEntry := func(i uint32, v uint32) {
+		off := int(i) * entrySize
+		if entrySize == 2 {
+			copy(out[off:off+2], le16(uint16(v)))
+		} else {
+			copy(out[off:off+4], le32(v&0x0FFFFFFF))
+		}
+	}
+	writeEntry(0, media)
+	eoc := uint32(fatEOC16)
+	if fw.fat32 {
+		eoc = fatEOC32
+	}
+	writeEntry(1, eoc)
+	for i := uint32(2); i < uint32(len(fw.fat)); i++ {
+		writeEntry(i, fw.fat[i])
+	}
+	return out
+}
+
+func (fw *fatWriter) write(f io.WriteSeeker, root *fatNode) error {
+	if _, err := f.Write(fw.bootSector()); err != nil {
+		return &isoBuildError{op: "write boot sector", err: err}
+	}
+	if fw.fat32 {
+		if _, err := f.Seek(int64(6)*fatBytesPerSector, io.SeekStart); err != nil {
+			return &isoBuildError{op: "seek backup boot sector", err: err}
+		}
+		if _, err := f.Write(fw.bootSector()); err != nil {
+			return &isoBuildError{op: "write backup boot sector", err: err}
+		}
+	}
+
+	if _, err := f.Seek(int64(fw.reservedSectors)*fatBytesPerSector, io.SeekStart); err != nil {
+		return &isoBuildError{op: "seek FAT", err: err}
+	}
+	fatBytes := fw.fatTableBytes()
+	for i := 0; i < fatNumFATs; i++ {
+		if _, err := f.Write(fatBytes); err != nil {
+			return &isoBuildError{op: "write FAT", err: err}
+		}
+	}
+
+	if !fw.fat32 {
+		rootArea := make([]byte, fw.rootDirSectors*fatBytesPerSector)
+		copy(rootArea, fw.rootDirBytes)
+		if _, err := f.Write(rootArea); err != nil {
+			return &isoBuildError{op: "write root directory", err: err}
+		}
+	}
+
+	var writeNode func(n *fatNode, isRoot bool) error
+	writeNode = func(n *fatNode, isRoot bool) error {
+		if !(isRoot && !fw.fat32) {
+			if err := fw.writeAtCluster(f, n.firstCluster, fw.dirBytes[n]); err != nil {
+				return err
+			}
+		}
+		for _, c := range n.children {
+			if c.isDir {
+				if err := writeNode(c, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if c.size == 0 {
+				continue
+			}
+			if err := fw.writeFileAtCluster(f, c.firstCluster, c.resolved); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeNode(root, true)
+}
+
+func (fw *fatWriter) clusterOffset(cluster uint32) int64 {
+	return int64(fw.firstDataSector+(cluster-2)*uint32(fw.sectorsPerCluster)) * fatBytesPerSector
+}
+
+func (fw *fatWriter) writeAtCluster(f io.WriteSeeker, cluster uint32, data []byte) error {
+	if _, err := f.Seek(fw.clusterOffset(cluster), io.SeekStart); err != nil {
+		return &isoBuildError{op: "seek cluster", err: err}
+	}
+	padded := data
+	if rem := len(padded) % fw.clusterSize; rem != 0 {
+		padded = append(append([]byte(nil), padded...), make([]byte, fw.clusterSize-rem)...)
+	}
+	if _, err := f.Write(padded); err != nil {
+		return &isoBuildError{op: "write cluster", err: err}
+	}
+	return nil
+}
+
+func (fw *fatWriter) writeFileAtCluster(f io.WriteSeeker, cluster uint32, source *resolvedSource) error {
+	if _, err := f.Seek(fw.clusterOffset(cluster), io.SeekStart); err != nil {
+		return &isoBuildError{file: source.Path, op: "seek cluster", err: err}
+	}
+	n, err := copyFileDataRaw(f, source)
+	if err != nil {
+		return err
+	}
+	allocated := int64(fatClustersFor(uint32(n), fw.clusterSize)) * int64(fw.clusterSize)
+	if rem := allocated - n; rem > 0 {
+		if _, err := f.Write(make([]byte, rem)); err != nil {
+			return &isoBuildError{file: source.Path, op: "pad cluster", err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNativeCreateVfatImageRoundTrip builds a small (well under 1MiB) vfat
+// config disk - the overwhelmingly common case for a real ConfigMap/Secret -
+// then parses the boot sector and root directory back out of the raw image
+// to confirm it reports FAT16 (not the FAT32 fallback) and that its cluster
+// count actually satisfies FAT16's own addressing minimum, and that the
+// file content reads back from the first cluster its directory entry names.
+func TestNativeCreateVfatImageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "user-data")
+	content := "#cloud-config\nhostname: test\n"
+	if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "cidata.img")
+	if err := nativeCreateVfatImage(out, "CIDATA", []string{"user-data=" + src}); err != nil {
+		t.Fatalf("nativeCreateVfatImage: %v", err)
+	}
+
+	img, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read built image: %v", err)
+	}
+	if len(img) < fatBytesPerSector {
+		t.Fatalf("image too small: %d bytes", len(img))
+	}
+
+	boot := img[:fatBytesPerSector]
+	sectorsPerCluster := int(boot[13])
+	reservedSectors := int(binary.LittleEndian.Uint16(boot[14:16]))
+	numFATs := int(boot[16])
+	rootEntries := int(binary.LittleEndian.Uint16(boot[17:19]))
+	fatSizeSectors := int(binary.LittleEndian.Uint16(boot[22:24]))
+	fsType := string(boot[54:62])
+
+	if fsType[:5] != "FAT16" {
+		t.Fatalf("small payload should stay on FAT16, boot sector claims %q", fsType)
+	}
+
+	totalSectors := binary.LittleEndian.Uint32(boot[32:36])
+	rootDirSectors := (rootEntries*fatDirEntrySize + fatBytesPerSector - 1) / fatBytesPerSector
+	firstDataSector := reservedSectors + numFATs*fatSizeSectors + rootDirSectors
+	totalClusters := (int(totalSectors) - firstDataSector) / sectorsPerCluster
+
+	if totalClusters < fat16MinClusters || totalClusters >= fat16MaxClusters {
+		t.Fatalf("cluster count %d does not satisfy the FAT16 range [%d, %d) the boot sector claims",
+			totalClusters, fat16MinClusters, fat16MaxClusters)
+	}
+
+	rootDirOffset := (reservedSectors + numFATs*fatSizeSectors) * fatBytesPerSector
+	rootDir := img[rootDirOffset : rootDirOffset+rootDirSectors*fatBytesPerSector]
+
+	var found bool
+	for off := 0; off+32 <= len(rootDir); off += 32 {
+		entry := rootDir[off : off+32]
+		if entry[0] == 0 {
+			break
+		}
+		if strings.TrimRight(string(entry[0:8]), " ") != "USER-DAT" {
+			continue
+		}
+		cluster := uint32(binary.LittleEndian.Uint16(entry[20:22]))<<16 | uint32(binary.LittleEndian.Uint16(entry[26:28]))
+		size := binary.LittleEndian.Uint32(entry[28:32])
+		clusterOffset := (firstDataSector + int(cluster-2)*sectorsPerCluster) * fatBytesPerSector
+		got := string(img[clusterOffset : clusterOffset+int(size)])
+		if got != content {
+			t.Fatalf("file content mismatch: got %q, want %q", got, content)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("user-data entry not found in root directory")
+	}
+}
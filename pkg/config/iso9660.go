@@ -0,0 +1,309 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	isoSectorSize = 2048
+	// isoCylinderAlignBytes mirrors xorrisofs' "-partition_cyl_align on",
+	// which rounds the image up to a cylinder boundary so that BIOSes
+	// doing CHS-style geometry assumptions don't choke on it. xorrisofs
+	// assumes a 64 head / 32 sector geometry, i.e. a 1MiB cylinder.
+	isoCylinderAlignBytes = 64 * 32 * 512
+
+	isoSystemAreaSectors = 16
+
+	// jolietMaxNameLen is the maximum number of UTF-16 characters
+	// permitted in a Joliet file identifier.
+	jolietMaxNameLen = 64
+)
+
+// isoBuildError carries enough context (which file, which operation) for a
+// caller to act on a failure instead of being handed a bare errno, which is
+// the whole reason this writer exists instead of shelling out.
+type isoBuildError struct {
+	file string
+	op   string
+	err  error
+}
+
+func (e *isoBuildError) Error() string {
+	if e.file == "" {
+		return fmt.Sprintf("iso9660: %s: %v", e.op, e.err)
+	}
+	return fmt.Sprintf("iso9660: %s %q: %v", e.op, e.file, e.err)
+}
+
+func (e *isoBuildError) Unwrap() error {
+	return e.err
+}
+
+// isoNode is a single entry (file or directory) in the tree we build out of
+// the graft-point list ("subdir/name=/host/path") handed to us by
+// getFilesLayout / createIsoConfigImage.
+type isoNode struct {
+	name     string // original, full fidelity name (used for Joliet and Rock Ridge NM)
+	isoName  string // 8.3, upper-cased, ISO9660 Level 1 identifier
+	isDir    bool
+	resolved *resolvedSource // symlink-checked source, only set for files
+	size     int64
+	mode     uint32 // POSIX permission override for Rock Ridge PX; 0 = writer default
+	parent   *isoNode
+	children []*isoNode
+
+	// filled in during layout()
+	extentLBA uint32
+	dataLen   uint32
+
+	// directory-only: location/size of this node's own extent in each tree.
+	dirPrimaryLBA, dirPrimarySize uint32
+	dirJolietLBA, dirJolietSize   uint32
+}
+
+// buildIsoTree turns the flat "name=path" graft-point list into a directory
+// tree, creating intermediate directories implied by any "/" in name. modes
+// is an optional graft-point-name -> POSIX mode override, as produced by
+// getProjectedFilesLayout for sources that set ProjectedSource.Mode.
+func buildIsoTree(files []string, modes map[string]uint32) (*isoNode, error) {
+	root := &isoNode{name: "", isoName: "", isDir: true}
+	for _, entry := range files {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, &isoBuildError{file: entry, op: "parse graft point", err: fmt.Errorf("expected NAME=PATH")}
+		}
+		graftName, source := parts[0], parts[1]
+
+		resolved, err := resolveUnderRoot(filepath.Dir(source), filepath.Base(source))
+		if err != nil {
+			return nil, &isoBuildError{file: source, op: "resolve", err: err}
+		}
+
+		segments := strings.Split(strings.Trim(graftName, "/"), "/")
+		dir := root
+		for _, seg := range segments[:len(segments)-1] {
+			dir = dir.childDir(seg)
+		}
+
+		leafName := segments[len(segments)-1]
+		if existing := dir.find(leafName); existing != nil {
+			return nil, &isoBuildError{file: graftName, op: "build layout", err: fmt.Errorf("duplicate entry")}
+		}
+		dir.children = append(dir.children, &isoNode{
+			name:     leafName,
+			resolved: resolved,
+			size:     resolved.Size,
+			mode:     modes[graftName],
+		})
+	}
+	return root, nil
+}
+
+func (n *isoNode) find(name string) *isoNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *isoNode) childDir(name string) *isoNode {
+	if existing := n.find(name); existing != nil {
+		return existing
+	}
+	d := &isoNode{name: name, isDir: true, parent: n}
+	n.children = append(n.children, d)
+	return d
+}
+
+// assignIsoNames computes the 8.3, upper-case ISO9660 Level 1 identifiers
+// for every node in the tree, appending a numeric suffix on collision.
+func assignIsoNames(n *isoNode) error {
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+	used := map[string]bool{}
+	for _, c := range n.children {
+		base, err := shortenIsoName(c.name, c.isDir)
+		if err != nil {
+			return &isoBuildError{file: c.name, op: "shorten name", err: err}
+		}
+		candidate := base
+		for i := 1; used[candidate]; i++ {
+			candidate = isoCollision(base, i, c.isDir)
+		}
+		used[candidate] = true
+		c.isoName = candidate
+		if c.isDir {
+			if err := assignIsoNames(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isoCollision renders the i-th disambiguated form of an 8.3 name that
+// collided with an already-assigned sibling, truncating only the base name
+// (never the extension or the mandatory ";1" version suffix for files) -
+// the same approach fat83Collision uses for FAT short names.
+func isoCollision(base string, i int, isDir bool) string {
+	suffix := fmt.Sprintf("~%d", i)
+	if isDir {
+		trimmed := base
+		if len(trimmed) > 8-len(suffix) {
+			trimmed = trimmed[:8-len(suffix)]
+		}
+		return trimmed + suffix
+	}
+
+	name := strings.TrimSuffix(base, ";1")
+	stem, ext := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		stem, ext = name[:i], name[i+1:]
+	}
+	if len(stem) > 8-len(suffix) {
+		stem = stem[:8-len(suffix)]
+	}
+	if ext == "" {
+		return stem + suffix + ";1"
+	}
+	return stem + suffix + "." + ext + ";1"
+}
+
+// shortenIsoName reduces an arbitrary file name down to an 8.3, upper-case,
+// d-character ISO9660 Level 1 identifier. Files additionally get the
+// mandatory ";1" version suffix.
+func shortenIsoName(name string, isDir bool) (string, error) {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				b.WriteRune(r)
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+
+	if isDir {
+		base := clean(name)
+		if len(base) > 8 {
+			base = base[:8]
+		}
+		if base == "" {
+			return "", fmt.Errorf("empty directory name")
+		}
+		return base, nil
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base = clean(base)
+	ext = clean(ext)
+	if len(base) > 8 {
+		base = base[:8]
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		return "", fmt.Errorf("empty file name")
+	}
+	if ext == "" {
+		return base + ";1", nil
+	}
+	return base + "." + ext + ";1", nil
+}
+
+// jolietUTF16 renders the full-fidelity name as big-endian UTF-16, truncated
+// to jolietMaxNameLen characters; '/' and other path separators can't occur
+// here because the tree is already split on them.
+func jolietUTF16(name string) []byte {
+	units := utf16.Encode([]rune(name))
+	if len(units) > jolietMaxNameLen {
+		units = units[:jolietMaxNameLen]
+	}
+	out := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
+
+// nativeCreateIsoImage builds an ISO9660 image with a Joliet Supplementary
+// Volume Descriptor (for long/unicode names) and Rock Ridge extensions (for
+// POSIX semantics) entirely in-process, without depending on xorrisofs. See
+// ECMA-119 for the on-disk layout and the Rock Ridge/SUSP 1.12 spec for the
+// "SP"/"PX"/"NM" system use entries it writes; no "SL" entries are written,
+// since every source is resolved through its symlinks before it is written.
+func nativeCreateIsoImage(output string, volID string, files []string, modes map[string]uint32) error {
+	if volID == "" {
+		volID = "cfgdata"
+	}
+
+	root, err := buildIsoTree(files, modes)
+	if err != nil {
+		return err
+	}
+	if err := assignIsoNames(root); err != nil {
+		return err
+	}
+
+	b := newIsoBuilder(volID)
+	if err := b.layout(root); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return &isoBuildError{file: output, op: "create", err: err}
+	}
+	defer f.Close()
+
+	if err := b.write(f); err != nil {
+		return err
+	}
+
+	size := int64(b.totalSectors) * isoSectorSize
+	if padded := alignUp(size, isoCylinderAlignBytes); padded != size {
+		if err := f.Truncate(padded); err != nil {
+			return &isoBuildError{file: output, op: "cylinder-align pad", err: err}
+		}
+	}
+	return nil
+}
+
+func alignUp(n, align int64) int64 {
+	if n%align == 0 {
+		return n
+	}
+	return n + (align - n%align)
+}
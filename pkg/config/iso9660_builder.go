@@ -0,0 +1,335 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"io"
+	"time"
+)
+
+// isoBuilder accumulates the volume-wide state (path table/volume descriptor
+// locations and sizes) needed to cross-reference the primary and Joliet
+// directory hierarchies while they're being laid out.
+type isoBuilder struct {
+	volID string
+	when  time.Time
+
+	totalSectors uint32
+
+	ptLPrimaryLBA, ptMPrimaryLBA, ptPrimarySize uint32
+	ptLJolietLBA, ptMJolietLBA, ptJolietSize    uint32
+
+	rootPrimaryLBA, rootPrimarySize uint32
+	rootJolietLBA, rootJolietSize   uint32
+
+	// write order, built up during layout() so write() can stream it
+	// straight out without having to re-derive offsets.
+	regions []isoRegion
+}
+
+// isoRegion is one contiguous, sector-aligned piece of the final image.
+// Exactly one of data/resolved is set; resolved defers the actual read (and
+// symlink-safety re-verification) until write time.
+type isoRegion struct {
+	data     []byte
+	resolved *resolvedSource
+}
+
+func newIsoBuilder(volID string) *isoBuilder {
+	return &isoBuilder{volID: volID, when: time.Now()}
+}
+
+// dirLevels walks the tree breadth-first, returning one slice of
+// directories per depth level. ECMA-119 path tables must be ordered by
+// level, and alphabetically by name within a level's parent.
+func dirLevels(root *isoNode) [][]*isoNode {
+	levels := [][]*isoNode{{root}}
+	current := []*isoNode{root}
+	for len(current) > 0 {
+		var next []*isoNode
+		for _, d := range current {
+			for _, c := range d.children {
+				if c.isDir {
+					next = append(next, c)
+				}
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		levels = append(levels, next)
+		current = next
+	}
+	return levels
+}
+
+func flattenLevels(levels [][]*isoNode) []*isoNode {
+	var out []*isoNode
+	for _, l := range levels {
+		out = append(out, l...)
+	}
+	return out
+}
+
+// layout assigns every directory and file an extent (LBA + size) and
+// renders the path tables and directory records, leaving nativeCreateIsoImage
+// to just stream isoBuilder.regions out to disk.
+func (b *isoBuilder) layout(root *isoNode) error {
+	levels := dirLevels(root)
+	dirs := flattenLevels(levels)
+
+	parentIdx := map[*isoNode]int{root: 1}
+	dirNum := map[*isoNode]int{}
+	for i, d := range dirs {
+		dirNum[d] = i + 1
+	}
+	for _, d := range dirs {
+		for _, c := range d.children {
+			if c.isDir {
+				parentIdx[c] = dirNum[d]
+			}
+		}
+	}
+
+	// Dry-render every directory's own extent so we know its sector count
+	// before any LBA has been decided (record lengths only depend on
+	// name/SUSP length, not on the LBA value itself).
+	primaryBytes := map[*isoNode][]byte{}
+	jolietBytes := map[*isoNode][]byte{}
+	for _, d := range dirs {
+		primaryBytes[d] = renderDirExtent(d, true, b.when)
+		jolietBytes[d] = renderDirExtent(d, false, b.when)
+	}
+
+	var files []*isoNode
+	var collectErr error
+	var collectFiles func(n *isoNode)
+	collectFiles = func(n *isoNode) {
+		for _, c := range n.children {
+			if c.isDir {
+				collectFiles(c)
+			} else {
+				if collectErr == nil {
+					collectErr = checkOverflow(c.name, c.size)
+				}
+				files = append(files, c)
+			}
+		}
+	}
+	collectFiles(root)
+	if collectErr != nil {
+		return collectErr
+	}
+
+	next := uint32(isoSystemAreaSectors)
+	next++ // PVD
+	next++ // SVD (Joliet)
+	next++ // Volume Descriptor Set Terminator
+
+	primaryPT := renderPathTable(dirs, parentIdx, true)
+	jolietPT := renderPathTable(dirs, parentIdx, false)
+	b.ptPrimarySize = uint32(len(primaryPT.le))
+	b.ptJolietSize = uint32(len(jolietPT.le))
+
+	b.ptLPrimaryLBA = next
+	next += sectorsFor(int64(len(primaryPT.le)))
+	b.ptMPrimaryLBA = next
+	next += sectorsFor(int64(len(primaryPT.be)))
+	b.ptLJolietLBA = next
+	next += sectorsFor(int64(len(jolietPT.le)))
+	b.ptMJolietLBA = next
+	next += sectorsFor(int64(len(jolietPT.be)))
+
+	for _, d := range dirs {
+		d.dirPrimaryLBA = next
+		d.dirPrimarySize = uint32(len(primaryBytes[d]))
+		next += sectorsFor(int64(len(primaryBytes[d])))
+	}
+	for _, d := range dirs {
+		d.dirJolietLBA = next
+		d.dirJolietSize = uint32(len(jolietBytes[d]))
+		next += sectorsFor(int64(len(jolietBytes[d])))
+	}
+	for _, f := range files {
+		f.extentLBA = next
+		f.dataLen = uint32(f.size)
+		next += sectorsFor(f.size)
+	}
+
+	b.rootPrimaryLBA, b.rootPrimarySize = root.dirPrimaryLBA, root.dirPrimarySize
+	b.rootJolietLBA, b.rootJolietSize = root.dirJolietLBA, root.dirJolietSize
+	b.totalSectors = next
+
+	// Now that every LBA is known, re-render the directory extents for
+	// real (earlier renders used placeholder LBA 0 purely to measure size).
+	for _, d := range dirs {
+		primaryBytes[d] = renderDirExtent(d, true, b.when)
+		jolietBytes[d] = renderDirExtent(d, false, b.when)
+	}
+
+	b.regions = append(b.regions, isoRegion{data: make([]byte, isoSystemAreaSectors*isoSectorSize)})
+	b.regions = append(b.regions, isoRegion{data: b.primaryVolumeDescriptor(b.when)})
+	b.regions = append(b.regions, isoRegion{data: b.supplementaryVolumeDescriptor(b.when)})
+	b.regions = append(b.regions, isoRegion{data: volumeDescriptorSetTerminator()})
+	b.regions = append(b.regions, isoRegion{data: sectorPad(primaryPT.le)})
+	b.regions = append(b.regions, isoRegion{data: sectorPad(primaryPT.be)})
+	b.regions = append(b.regions, isoRegion{data: sectorPad(jolietPT.le)})
+	b.regions = append(b.regions, isoRegion{data: sectorPad(jolietPT.be)})
+	for _, d := range dirs {
+		b.regions = append(b.regions, isoRegion{data: sectorPad(primaryBytes[d])})
+	}
+	for _, d := range dirs {
+		b.regions = append(b.regions, isoRegion{data: sectorPad(jolietBytes[d])})
+	}
+	for _, f := range files {
+		b.regions = append(b.regions, isoRegion{resolved: f.resolved})
+	}
+
+	return nil
+}
+
+func sectorPad(b []byte) []byte {
+	if rem := len(b) % isoSectorSize; rem != 0 {
+		b = append(b, make([]byte, isoSectorSize-rem)...)
+	}
+	return b
+}
+
+func (b *isoBuilder) write(f io.Writer) error {
+	for _, r := range b.regions {
+		if r.resolved != nil {
+			if _, err := copyFileData(f, r.resolved); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := f.Write(r.data); err != nil {
+			return &isoBuildError{op: "write", err: err}
+		}
+	}
+	return nil
+}
+
+// renderDirExtent renders the "." and ".." records plus one record per
+// child for a single directory, in the primary (Level 1 + Rock Ridge) or
+// Joliet charset.
+func renderDirExtent(d *isoNode, primary bool, when time.Time) []byte {
+	var out []byte
+
+	selfLBA, selfSize := d.dirPrimaryLBA, d.dirPrimarySize
+	if !primary {
+		selfLBA, selfSize = d.dirJolietLBA, d.dirJolietSize
+	}
+
+	var susp []byte
+	if primary {
+		susp = rockRidgeSUSP(d, "", d.parent == nil)
+	}
+	out = append(out, isoDirRecord([]byte{0}, selfLBA, selfSize, true, when, susp)...)
+
+	parentLBA, parentSize := selfLBA, selfSize
+	if d.parent != nil {
+		parentLBA, parentSize = d.parent.dirPrimaryLBA, d.parent.dirPrimarySize
+		if !primary {
+			parentLBA, parentSize = d.parent.dirJolietLBA, d.parent.dirJolietSize
+		}
+	}
+	var parentSUSP []byte
+	if primary {
+		parentNode := d.parent
+		if parentNode == nil {
+			parentNode = d
+		}
+		parentSUSP = rockRidgeSUSP(parentNode, "", false)
+	}
+	out = append(out, isoDirRecord([]byte{1}, parentLBA, parentSize, true, when, parentSUSP)...)
+
+	for _, c := range d.children {
+		var ident []byte
+		var lba, size uint32
+		var rr []byte
+		if c.isDir {
+			ident = []byte(c.isoName)
+			lba, size = c.dirPrimaryLBA, c.dirPrimarySize
+			if !primary {
+				ident = jolietUTF16(c.name)
+				lba, size = c.dirJolietLBA, c.dirJolietSize
+			}
+		} else {
+			ident = []byte(c.isoName)
+			lba, size = c.extentLBA, c.dataLen
+			if !primary {
+				ident = jolietUTF16(c.name)
+			}
+		}
+		if primary {
+			rr = rockRidgeSUSP(c, c.name, false)
+		}
+		out = append(out, isoDirRecord(ident, lba, size, c.isDir, when, rr)...)
+	}
+	return out
+}
+
+type pathTableBytes struct {
+	le []byte
+	be []byte
+}
+
+// renderPathTable renders both byte orders (Type L and Type M) of the
+// ECMA-119 path table for either the primary or Joliet directory names.
+func renderPathTable(dirs []*isoNode, parentIdx map[*isoNode]int, primary bool) pathTableBytes {
+	var le, be []byte
+	for _, d := range dirs {
+		var ident []byte
+		var lba uint32
+		if primary {
+			ident = []byte(d.isoName)
+			lba = d.dirPrimaryLBA
+		} else {
+			ident = jolietUTF16(d.name)
+			lba = d.dirJolietLBA
+		}
+		if d.parent == nil {
+			ident = []byte{0}
+		}
+		pad := byte(0)
+		if len(ident)%2 != 0 {
+			pad = 1
+		}
+
+		leRec := make([]byte, 8+len(ident)+int(pad))
+		leRec[0] = byte(len(ident))
+		leRec[1] = 0
+		copy(leRec[2:6], encode731(lba))
+		copy(leRec[6:8], encode721(uint16(parentIdx[d])))
+		copy(leRec[8:], ident)
+		le = append(le, leRec...)
+
+		beRec := make([]byte, 8+len(ident)+int(pad))
+		beRec[0] = byte(len(ident))
+		beRec[1] = 0
+		copy(beRec[2:6], encode732(lba))
+		be16 := []byte{byte(parentIdx[d] >> 8), byte(parentIdx[d])}
+		copy(beRec[6:8], be16)
+		copy(beRec[8:], ident)
+		be = append(be, beRec...)
+	}
+	return pathTableBytes{le: le, be: be}
+}
@@ -0,0 +1,305 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// encode721 is the ECMA-119 "721" 2-byte little-endian field.
+func encode721(v uint16) []byte {
+	return []byte{byte(v), byte(v >> 8)}
+}
+
+// encode723 is the ECMA-119 both-byte-order 2-byte field (LE then BE).
+func encode723(v uint16) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 8), byte(v)}
+}
+
+// encode731 is the both-byte-order 4-byte field, little-endian half only
+// (used for the Type L path table location).
+func encode731(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+// encode732 is the big-endian half of a both-byte-order 4-byte field (used
+// for the Type M path table location).
+func encode732(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// encode733 is the ECMA-119 both-byte-order 8-byte field (LE then BE),
+// used for extent locations and data lengths.
+func encode733(v uint32) []byte {
+	out := make([]byte, 8)
+	copy(out[0:4], encode731(v))
+	copy(out[4:8], encode732(v))
+	return out
+}
+
+func padBytes(s string, n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = ' '
+	}
+	copy(out, s)
+	return out
+}
+
+// isoDateTime is the 17-byte "volume descriptor" date/time format:
+// 4+2+2+2+2+2+2 ASCII digits plus a GMT offset byte.
+func isoDateTime(t time.Time) []byte {
+	s := t.UTC().Format("20060102150405") + "00"
+	out := make([]byte, 17)
+	copy(out, s)
+	out[16] = 0
+	return out
+}
+
+// isoDirDateTime is the 7-byte directory record recording date/time.
+func isoDirDateTime(t time.Time) []byte {
+	u := t.UTC()
+	return []byte{
+		byte(u.Year() - 1900),
+		byte(u.Month()),
+		byte(u.Day()),
+		byte(u.Hour()),
+		byte(u.Minute()),
+		byte(u.Second()),
+		0, // GMT offset in 15-minute intervals
+	}
+}
+
+const (
+	dirFlagHidden    = 1 << 0
+	dirFlagDirectory = 1 << 1
+)
+
+// rockRidgeSUSP builds the System Use Sharing Protocol entries for a single
+// directory record: PX (POSIX attributes) always, NM (alternate/full name)
+// whenever fullName is non-empty, and SP (SUSP indicator) only on the
+// "." entry of the root directory, as required by the Rock Ridge spec.
+func rockRidgeSUSP(n *isoNode, fullName string, includeSP bool) []byte {
+	var out []byte
+
+	if includeSP {
+		// "SP" indicator: signature, len=7, version=1, check bytes, skip=0
+		out = append(out, 'S', 'P', 7, 1, 0xBE, 0xEF, 0)
+	}
+
+	mode := uint32(0o100644)
+	if n != nil && n.isDir {
+		mode = 0o040755
+	}
+	if n != nil && n.mode != 0 {
+		// n.mode only carries permission bits (e.g. from
+		// ProjectedSource.Mode); keep the file-type bits above.
+		mode = mode&^0o7777 | n.mode&0o7777
+	}
+	px := make([]byte, 36)
+	px[0], px[1] = 'P', 'X'
+	px[2] = 36
+	px[3] = 1
+	copy(px[4:12], encode733(mode))
+	copy(px[12:20], encode733(1)) // link count
+	copy(px[20:28], encode733(0)) // uid
+	copy(px[28:36], encode733(0)) // gid
+	out = append(out, px...)
+
+	if fullName != "" {
+		nameBytes := []byte(fullName)
+		nm := make([]byte, 5+len(nameBytes))
+		nm[0], nm[1] = 'N', 'M'
+		nm[2] = byte(len(nm))
+		nm[3] = 1
+		nm[4] = 0 // flags: name continues in no further entry
+		copy(nm[5:], nameBytes)
+		out = append(out, nm...)
+	}
+
+	return out
+}
+
+// isoDirRecord renders a single ECMA-119 directory record. identifier is
+// already in the target charset (d-characters for primary, UTF-16BE for
+// Joliet); susp is appended System Use data (Rock Ridge), only meaningful
+// on the primary tree.
+func isoDirRecord(identifier []byte, lba, size uint32, isDir bool, when time.Time, susp []byte) []byte {
+	idLen := len(identifier)
+	// Directory record length must be even; pad identifier field with a
+	// single NUL byte when idLen is even (per spec the field itself is
+	// padded to even length including the 1-byte padding if needed).
+	idField := idLen
+	pad := 0
+	if idField%2 == 0 {
+		pad = 1
+	}
+
+	recLen := 33 + idField + pad + len(susp)
+	if recLen%2 != 0 {
+		recLen++ // odd-length System Use data: trailing NUL keeps the record even
+	}
+	rec := make([]byte, recLen)
+	rec[0] = byte(recLen)
+	rec[1] = 0 // XAR length
+	copy(rec[2:10], encode733(lba))
+	copy(rec[10:18], encode733(size))
+	copy(rec[18:25], isoDirDateTime(when))
+	flags := byte(0)
+	if isDir {
+		flags |= dirFlagDirectory
+	}
+	rec[25] = flags
+	rec[26] = 0 // file unit size
+	rec[27] = 0 // interleave gap
+	copy(rec[28:32], encode723(1)) // volume sequence number
+	rec[32] = byte(idLen)
+	copy(rec[33:33+idLen], identifier)
+	copy(rec[33+idLen+pad:], susp)
+	return rec
+}
+
+func (b *isoBuilder) primaryVolumeDescriptor(when time.Time) []byte {
+	d := make([]byte, isoSectorSize)
+	d[0] = 1 // PVD type
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	copy(d[8:40], padBytes("", 32))
+	copy(d[40:72], padBytes(b.volID, 32))
+	copy(d[80:88], encode733(b.totalSectors))
+	copy(d[120:124], encode723(1))
+	copy(d[124:128], encode723(1))
+	copy(d[128:132], encode723(isoSectorSize))
+	copy(d[132:140], encode733(b.ptPrimarySize))
+	copy(d[140:144], encode731(b.ptLPrimaryLBA))
+	copy(d[148:152], encode732(b.ptMPrimaryLBA))
+	rootRec := isoDirRecord([]byte{0}, b.rootPrimaryLBA, b.rootPrimarySize, true, when, nil)
+	copy(d[156:156+len(rootRec)], rootRec)
+	copy(d[190:318], padBytes("", 128))
+	copy(d[318:446], padBytes("", 128))
+	copy(d[446:574], padBytes("", 128))
+	copy(d[574:702], padBytes("", 128))
+	copy(d[814:831], isoDateTime(when))
+	copy(d[831:848], isoDateTime(when))
+	copy(d[848:865], isoDateTime(when))
+	copy(d[865:882], isoDateTime(when))
+	d[882] = 1
+	return d
+}
+
+func (b *isoBuilder) supplementaryVolumeDescriptor(when time.Time) []byte {
+	d := make([]byte, isoSectorSize)
+	d[0] = 2 // SVD type
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	copy(d[8:40], padBytes("", 32))
+	// UCS-2 Level 3 (Joliet) escape sequence.
+	copy(d[88:91], []byte{0x25, 0x2F, 0x45})
+	copy(d[40:72], jolietPadded(b.volID, 32))
+	copy(d[80:88], encode733(b.totalSectors))
+	copy(d[120:124], encode723(1))
+	copy(d[124:128], encode723(1))
+	copy(d[128:132], encode723(isoSectorSize))
+	copy(d[132:140], encode733(b.ptJolietSize))
+	copy(d[140:144], encode731(b.ptLJolietLBA))
+	copy(d[148:152], encode732(b.ptMJolietLBA))
+	rootRec := isoDirRecord([]byte{0}, b.rootJolietLBA, b.rootJolietSize, true, when, nil)
+	copy(d[156:156+len(rootRec)], rootRec)
+	copy(d[814:831], isoDateTime(when))
+	copy(d[831:848], isoDateTime(when))
+	copy(d[848:865], isoDateTime(when))
+	copy(d[865:882], isoDateTime(when))
+	d[882] = 1
+	return d
+}
+
+func jolietPadded(s string, n int) []byte {
+	u := jolietUTF16(s)
+	out := make([]byte, n)
+	copy(out, u)
+	for i := len(u); i+1 < n; i += 2 {
+		out[i], out[i+1] = 0, ' '
+	}
+	return out
+}
+
+func volumeDescriptorSetTerminator() []byte {
+	d := make([]byte, isoSectorSize)
+	d[0] = 255
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	return d
+}
+
+// copyFileDataRaw streams a source file into w with no padding. source is
+// re-resolved and re-checked against the dev/ino recorded when the tree was
+// enumerated immediately before being read, closing the window between "we
+// decided this file is safe" and "we actually read its bytes into the
+// image".
+func copyFileDataRaw(w io.Writer, source *resolvedSource) (int64, error) {
+	src, err := source.Reopen()
+	if err != nil {
+		return 0, &isoBuildError{file: source.Path, op: "open", err: err}
+	}
+	defer src.Close()
+
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, &isoBuildError{file: source.Path, op: "read", err: err}
+	}
+	if n != source.Size {
+		// The directory record/path table entries for this file were
+		// already computed from source.Size at tree-build time; writing a
+		// different number of bytes here would desync every subsequent
+		// region's real offset from what the image claims, so this must be
+		// a hard failure rather than a silently truncated/overrun image.
+		return n, &isoBuildError{file: source.Path, op: "read", err: fmt.Errorf("size changed since enumeration: expected %d bytes, read %d", source.Size, n)}
+	}
+	return n, nil
+}
+
+// copyFileData streams a source file into w, sector-padding the final
+// partial ISO9660 sector with zero bytes.
+func copyFileData(w io.Writer, source *resolvedSource) (int64, error) {
+	n, err := copyFileDataRaw(w, source)
+	if err != nil {
+		return n, err
+	}
+	if rem := n % isoSectorSize; rem != 0 {
+		if _, err := w.Write(make([]byte, isoSectorSize-rem)); err != nil {
+			return n, &isoBuildError{file: source.Path, op: "pad", err: err}
+		}
+	}
+	return n, nil
+}
+
+func sectorsFor(size int64) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func checkOverflow(node string, size int64) error {
+	const maxUint32 = 1<<32 - 1
+	if size > maxUint32 {
+		return &isoBuildError{file: node, op: "layout", err: fmt.Errorf("file too large for ISO9660 (%d bytes > 4GiB-1)", size)}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// isoFileEntry is a parsed ECMA-119 directory record for a non-directory
+// child, enough to read the file's content back out of the image.
+type isoFileEntry struct {
+	ident     string
+	lba, size uint32
+}
+
+// parseIsoRootDir reads the primary volume descriptor out of img and returns
+// every file (non-"."/".."/directory) entry in the root directory.
+func parseIsoRootDir(t *testing.T, img []byte) []isoFileEntry {
+	t.Helper()
+
+	pvd := img[isoSystemAreaSectors*isoSectorSize : (isoSystemAreaSectors+1)*isoSectorSize]
+	rootRec := pvd[156:]
+	rootLBA := binary.LittleEndian.Uint32(rootRec[2:6])
+	rootSize := binary.LittleEndian.Uint32(rootRec[10:14])
+
+	start := int(rootLBA) * isoSectorSize
+	rootDir := img[start : start+int(rootSize)]
+
+	var entries []isoFileEntry
+	for off := 0; off < len(rootDir); {
+		recLen := int(rootDir[off])
+		if recLen == 0 {
+			break
+		}
+		idLen := int(rootDir[off+32])
+		ident := string(rootDir[off+33 : off+33+idLen])
+		flags := rootDir[off+25]
+		if ident != "\x00" && ident != "\x01" && flags&dirFlagDirectory == 0 {
+			entries = append(entries, isoFileEntry{
+				ident: ident,
+				lba:   binary.LittleEndian.Uint32(rootDir[off+2 : off+6]),
+				size:  binary.LittleEndian.Uint32(rootDir[off+10 : off+14]),
+			})
+		}
+		off += recLen
+	}
+	return entries
+}
+
+// TestNativeCreateIsoImageRoundTrip builds an image with two files whose 8.3
+// names collide, then parses the result back out of the raw bytes (the way
+// a real ISO9660 driver would) to make sure both survive as distinct,
+// readable entries - the collision disambiguation must not have dropped the
+// mandatory ";1" version suffix or the file extension.
+func TestNativeCreateIsoImageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeSource := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return p
+	}
+
+	aPath := writeSource("long-file-name-a.txt", "hello from a")
+	bPath := writeSource("long-file-name-b.txt", "hello from b")
+
+	out := filepath.Join(dir, "cfg.iso")
+	files := []string{
+		"long-file-name-a.txt=" + aPath,
+		"long-file-name-b.txt=" + bPath,
+	}
+	if err := nativeCreateIsoImage(out, "CIDATA", files, nil); err != nil {
+		t.Fatalf("nativeCreateIsoImage: %v", err)
+	}
+
+	img, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read built image: %v", err)
+	}
+
+	entries := parseIsoRootDir(t, img)
+	if len(entries) != 2 {
+		t.Fatalf("want 2 file entries in root directory, got %d: %+v", len(entries), entries)
+	}
+
+	seen := map[string]bool{}
+	wantContent := map[string]string{
+		aPath: "hello from a",
+		bPath: "hello from b",
+	}
+	gotContent := map[string]bool{}
+	for _, e := range entries {
+		if seen[e.ident] {
+			t.Fatalf("duplicate identifier %q - collision disambiguation failed", e.ident)
+		}
+		seen[e.ident] = true
+		if !strings.HasSuffix(e.ident, ".TXT;1") {
+			t.Errorf("identifier %q lost its extension and/or version suffix on collision", e.ident)
+		}
+		start := int(e.lba) * isoSectorSize
+		content := string(img[start : start+int(e.size)])
+		for _, want := range wantContent {
+			if content == want {
+				gotContent[want] = true
+			}
+		}
+	}
+	for path, want := range wantContent {
+		if !gotContent[want] {
+			t.Errorf("content of %s (%q) not found anywhere in the built image", path, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolvedSource is a file that has been proven to resolve under its
+// configured source directory - the same technique kubelet's subPath
+// handling uses (EvalSymlinks, then check the final target is still a
+// descendant of root) to keep a container from escaping its volume mount.
+// Unlike a blanket O_NOFOLLOW, this follows symlinks - required for the
+// "key" -> "..data/key" -> "..<timestamp>/key" chain every ConfigMap/
+// Secret/DownwardAPI/ServiceAccount atomic-writer volume presents - and
+// only refuses a path whose fully-resolved target escapes root. dev/ino
+// are captured at resolve time so Reopen can detect the file being swapped
+// for something else before it's actually read.
+type resolvedSource struct {
+	// Name is the graft-point relative name, e.g. "my-key".
+	Name string
+	// Path is root+Name, for error messages/graft-point lists only; always
+	// go through Reopen to actually read the file's contents.
+	Path string
+	Size int64
+
+	root string
+	rel  string
+	dev  uint64
+	ino  uint64
+}
+
+// resolveUnderRoot resolves rel (which may contain "/") relative to root,
+// following any symlinks along the way - including the "..data" indirection
+// kubelet's atomic writer uses - and refuses it only if the fully-resolved
+// target isn't a descendant of root. A rel that contains "." or ".." is
+// refused outright.
+func resolveUnderRoot(root, rel string) (*resolvedSource, error) {
+	f, dev, ino, size, err := openUnderRootChecked(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &resolvedSource{
+		Name: rel,
+		Path: filepath.Join(root, rel),
+		Size: size,
+		root: root,
+		rel:  rel,
+		dev:  dev,
+		ino:  ino,
+	}, nil
+}
+
+// Reopen re-resolves the file under its root and hands back an open file
+// only if it still has the same device+inode observed when it was first
+// resolved - e.g. a ConfigMap's atomic "..data" symlink swap landing on a
+// completely different file between enumeration and read.
+func (r *resolvedSource) Reopen() (*os.File, error) {
+	f, dev, ino, _, err := openUnderRootChecked(r.root, r.rel)
+	if err != nil {
+		return nil, err
+	}
+	if dev != r.dev || ino != r.ino {
+		f.Close()
+		return nil, fmt.Errorf("%q changed identity since it was enumerated (want dev=%d/ino=%d, got dev=%d/ino=%d)",
+			r.Path, r.dev, r.ino, dev, ino)
+	}
+	return f, nil
+}
+
+// openUnderRootChecked resolves root+rel with filepath.EvalSymlinks - which
+// walks through every symlink in the path the same way kubelet's
+// EvalHostSymlinks does for subPath mounts, rather than refusing to traverse
+// them - then opens the fully-resolved target with O_NOFOLLOW (it's already
+// the final, non-symlink path, so this just guards against a TOCTOU race
+// where the last component is swapped for a symlink between the Eval and
+// the Open) and verifies that target is still a descendant of root. Only a
+// rel containing "." or ".." segments, or one whose resolved target escapes
+// root entirely, is refused.
+func openUnderRootChecked(root, rel string) (f *os.File, dev, ino uint64, size int64, err error) {
+	for _, seg := range strings.Split(rel, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return nil, 0, 0, 0, fmt.Errorf("%q escapes source directory %q", rel, root)
+		}
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, 0, 0, 0, fmt.Errorf("resolve source directory %q: %w", root, err)
+	}
+
+	realTarget, err := filepath.EvalSymlinks(filepath.Join(root, rel))
+	if err != nil {
+		return nil, 0, 0, 0, fmt.Errorf("%q does not resolve under %q: %w", rel, root, err)
+	}
+	if realTarget != realRoot && !strings.HasPrefix(realTarget, realRoot+string(filepath.Separator)) {
+		return nil, 0, 0, 0, fmt.Errorf("%q escapes source directory %q (resolves to %q)", rel, root, realTarget)
+	}
+
+	fd, err := unix.Open(realTarget, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, 0, 0, 0, fmt.Errorf("open %q (resolved from %q under %q): %w", realTarget, rel, root, err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, 0, 0, 0, fmt.Errorf("fstat %q under %q: %w", rel, root, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		unix.Close(fd)
+		return nil, 0, 0, 0, fmt.Errorf("%q under %q is not a plain file or directory", rel, root)
+	}
+
+	return os.NewFile(uintptr(fd), realTarget), uint64(st.Dev), st.Ino, st.Size, nil
+}
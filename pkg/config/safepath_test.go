@@ -0,0 +1,94 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResolveUnderRootKubeletAtomicWriter reproduces the exact layout
+// kubelet's atomic writer leaves behind for every ConfigMap/Secret/
+// DownwardAPI/ServiceAccount mount: a timestamped directory holding the
+// real files, a "..data" symlink pointing at it, and each key as a symlink
+// through "..data". resolveUnderRoot must follow this chain rather than
+// refuse it.
+func TestResolveUnderRootKubeletAtomicWriter(t *testing.T) {
+	dir := t.TempDir()
+	timestamped := filepath.Join(dir, "..2024_01_01_00_00_00.000000000")
+	if err := os.Mkdir(timestamped, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(timestamped, "my-key"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Base(timestamped), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "my-key"), filepath.Join(dir, "my-key")); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := resolveUnderRoot(dir, "my-key")
+	if err != nil {
+		t.Fatalf("legitimate kubelet-style ConfigMap symlink chain was refused: %v", err)
+	}
+	f, err := resolved.Reopen()
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	defer f.Close()
+	content := make([]byte, 5)
+	if _, err := f.Read(content); err != nil {
+		t.Fatalf("read resolved file: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Fatalf("got %q, want %q", content, "hello")
+	}
+}
+
+// TestResolveUnderRootEscapeRefused is the negative counterpart: a symlink
+// that resolves outside of root must still be refused, even though
+// resolution now follows symlinks instead of blanket-refusing them.
+func TestResolveUnderRootEscapeRefused(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "host-secret")
+	if err := os.WriteFile(secret, []byte("do not leak"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolveUnderRoot(root, "escape"); err == nil {
+		t.Fatal("symlink escaping root was not refused")
+	}
+}
+
+// TestResolveUnderRootRejectsDotDot makes sure a rel path can't sidestep the
+// resolver via literal ".." segments.
+func TestResolveUnderRootRejectsDotDot(t *testing.T) {
+	root := t.TempDir()
+	if _, err := resolveUnderRoot(root, "../etc/passwd"); err == nil {
+		t.Fatal("\"..\" path component was not refused")
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	v1 "kubevirt.io/client-go/api/v1"
+)
+
+// coalesceWindow bounds how often a single volume is rebuilt while its
+// source directory is being updated in a burst. A kubelet "..data" symlink
+// swap for a single ConfigMap update can still surface as more than one
+// fsnotify event; we only want one rebuild out of the whole burst.
+const coalesceWindow = 2 * time.Second
+
+// VolumeStatusNotifier lets DiskWatcher surface a reconciliation event on
+// the VMI - e.g. by setting VolumeStatus.Message or a dedicated condition -
+// without this package needing to depend on the VMI status-update client.
+type VolumeStatusNotifier interface {
+	NotifyConfigDiskUpdated(volumeName, message string) error
+}
+
+// WatchedDisk describes a single live config disk being kept in sync with
+// its ConfigMap/Secret/etc. source directory. Format/Layout mirror
+// ConfigDiskSpec and must carry whatever non-default choice the disk was
+// originally built with - rebuild calls back into createIsoConfigImage with
+// the same spec shape, and an unset Format/Layout there silently downgrades
+// the disk back to ISO9660Format/GenericLayout on the next source change.
+type WatchedDisk struct {
+	VolumeName string
+	SourceDir  string
+	DiskPath   string
+	VolID      string
+	Format     Format
+	Layout     DatasourceLayout
+	// Sources is set instead of SourceDir for a Projected volume's merged
+	// disk; SourceDir is still used to pick which of the sources' directories
+	// this particular watch reacts to.
+	Sources []ProjectedSource
+}
+
+// VolumeWantsLiveUpdate reports whether a ConfigMap/Secret volume opted
+// into live reconciliation via the `LiveUpdate` field on
+// v1.ConfigMapVolumeSource/v1.SecretVolumeSource; existing VMIs that
+// don't set it keep today's build-once-at-startup behavior.
+func VolumeWantsLiveUpdate(volume *v1.Volume) bool {
+	switch {
+	case volume.ConfigMap != nil:
+		return volume.ConfigMap.LiveUpdate
+	case volume.Secret != nil:
+		return volume.Secret.LiveUpdate
+	}
+	return false
+}
+
+// DiskWatcher rebuilds a set of config ISOs whenever the source directory
+// backing them changes, instead of only once at VMI startup. Rebuilds are
+// skipped unless the file set actually changed, and go to a temp path that
+// is renamed over the live disk so a concurrent guest read never observes
+// a half-written image.
+type DiskWatcher struct {
+	notifier VolumeStatusNotifier
+	watcher  *fsnotify.Watcher
+
+	mu     sync.Mutex
+	disks  map[string]*watchedDisk // keyed by SourceDir
+	stopCh chan struct{}
+}
+
+type watchedDisk struct {
+	disk     WatchedDisk
+	lastHash string
+	timer    *time.Timer
+}
+
+// NewDiskWatcher starts the background goroutine that reacts to fsnotify
+// events; call Add for each config disk that should be kept live.
+func NewDiskWatcher(notifier VolumeStatusNotifier) (*DiskWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
+	}
+	dw := &DiskWatcher{
+		notifier: notifier,
+		watcher:  fsw,
+		disks:    map[string]*watchedDisk{},
+		stopCh:   make(chan struct{}),
+	}
+	go dw.run()
+	return dw, nil
+}
+
+// Add starts watching disk.SourceDir and performs an initial build so the
+// on-disk image reflects the current content even if nothing changes later.
+func (dw *DiskWatcher) Add(disk WatchedDisk) error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if err := dw.watcher.Add(disk.SourceDir); err != nil {
+		return fmt.Errorf("failed to watch %q: %w", disk.SourceDir, err)
+	}
+	st := &watchedDisk{disk: disk}
+	dw.disks[disk.SourceDir] = st
+	return dw.rebuild(st)
+}
+
+// Remove stops watching a previously added disk, e.g. on VMI shutdown or
+// volume hot-unplug.
+func (dw *DiskWatcher) Remove(sourceDir string) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if st, ok := dw.disks[sourceDir]; ok {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		delete(dw.disks, sourceDir)
+	}
+	_ = dw.watcher.Remove(sourceDir)
+}
+
+// Close stops the watcher and its background goroutine.
+func (dw *DiskWatcher) Close() error {
+	close(dw.stopCh)
+	return dw.watcher.Close()
+}
+
+func (dw *DiskWatcher) run() {
+	for {
+		select {
+		case <-dw.stopCh:
+			return
+		case ev, ok := <-dw.watcher.Events:
+			if !ok {
+				return
+			}
+			dw.schedule(filepath.Dir(ev.Name))
+		case _, ok := <-dw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Best-effort: a dropped event just delays the sync until the
+			// next write to the same directory.
+		}
+	}
+}
+
+// schedule coalesces a burst of events for the same source directory into
+// a single rebuild, fired coalesceWindow after the last observed event.
+func (dw *DiskWatcher) schedule(sourceDir string) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	st, ok := dw.disks[sourceDir]
+	if !ok {
+		return
+	}
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.timer = time.AfterFunc(coalesceWindow, func() {
+		dw.mu.Lock()
+		defer dw.mu.Unlock()
+		if err := dw.rebuild(st); err != nil && dw.notifier != nil {
+			_ = dw.notifier.NotifyConfigDiskUpdated(st.disk.VolumeName, fmt.Sprintf("failed to refresh config disk: %v", err))
+		}
+	})
+}
+
+// rebuild hashes the current file set and, only if it changed since the
+// last build, writes a fresh ISO to a temp path and atomically renames it
+// over the live disk.
+func (dw *DiskWatcher) rebuild(st *watchedDisk) error {
+	var files []string
+	var err error
+	if len(st.disk.Sources) > 0 {
+		files, _, err = getProjectedFilesLayout(st.disk.Sources)
+	} else {
+		files, err = getFilesLayout(st.disk.SourceDir)
+	}
+	if err != nil {
+		return err
+	}
+	hash, err := hashFileSet(files)
+	if err != nil {
+		return err
+	}
+	if hash == st.lastHash {
+		return nil
+	}
+
+	tmp := st.disk.DiskPath + ".tmp"
+	spec := ConfigDiskSpec{
+		Output:  tmp,
+		VolID:   st.disk.VolID,
+		Files:   files,
+		Sources: st.disk.Sources,
+		Format:  st.disk.Format,
+		Layout:  st.disk.Layout,
+	}
+	if err := createIsoConfigImage(spec); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, st.disk.DiskPath); err != nil {
+		return fmt.Errorf("failed to publish refreshed config disk %q: %w", st.disk.DiskPath, err)
+	}
+	st.lastHash = hash
+
+	if dw.notifier != nil {
+		return dw.notifier.NotifyConfigDiskUpdated(st.disk.VolumeName, "config disk contents changed; guest remount or cloud-init re-run may be required")
+	}
+	return nil
+}
+
+// hashFileSet hashes both the graft-point names and the content of every
+// file, so unrelated metadata churn (e.g. mtime-only changes) can't trigger
+// a rebuild and a real content change can never be missed.
+func hashFileSet(files []string) (string, error) {
+	h := sha256.New()
+	for _, entry := range files {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, path := parts[0], parts[1]
+		fmt.Fprintf(h, "%s\x00", name)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return "", &isoBuildError{file: path, op: "hash", err: err}
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", &isoBuildError{file: path, op: "hash", err: err}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
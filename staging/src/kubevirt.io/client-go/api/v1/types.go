@@ -0,0 +1,126 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2018 Red Hat, Inc.
+ *
+ */
+
+// Package v1 is the subset of kubevirt.io/client-go/api/v1's VMI/Volume API
+// that pkg/config depends on. It only carries the fields pkg/config actually
+// reads; the rest of the real type (PersistentVolumeClaim/DataVolume/
+// ContainerDisk sources, full ObjectMeta/TypeMeta, etc.) lives upstream.
+package v1
+
+// VirtualMachineInstance is a virtual machine instance.
+// +k8s:deepcopy-gen=true
+type VirtualMachineInstance struct {
+	Status VirtualMachineInstanceStatus `json:"status,omitempty"`
+}
+
+// VirtualMachineInstanceStatus represents information about the status of a
+// VMI.
+// +k8s:deepcopy-gen=true
+type VirtualMachineInstanceStatus struct {
+	VolumeStatus []VolumeStatus `json:"volumeStatus,omitempty"`
+}
+
+// VolumeStatus represents information about the status of a volume attached
+// to the VMI, keyed by Name.
+// +k8s:deepcopy-gen=true
+type VolumeStatus struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Volume represents a named volume in a pod that should be attached to the
+// VM.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type Volume struct {
+	Name string `json:"name"`
+	VolumeSource
+}
+
+// VolumeSource represents the source of a volume to mount. Only one of its
+// members may be specified.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type VolumeSource struct {
+	ConfigMap *ConfigMapVolumeSource `json:"configMap,omitempty"`
+	Secret    *SecretVolumeSource    `json:"secret,omitempty"`
+	Projected *ProjectedVolumeSource `json:"projected,omitempty"`
+}
+
+// ConfigMapVolumeSource adapts a ConfigMap into a volume, attached as a
+// config disk.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type ConfigMapVolumeSource struct {
+	Name string `json:"name,omitempty"`
+	// LiveUpdate opts this volume into live reconciliation: the config
+	// disk is rebuilt and hot-swapped whenever the backing ConfigMap
+	// changes, instead of only being built once at VMI startup.
+	// +optional
+	LiveUpdate bool `json:"liveUpdate,omitempty"`
+	// Format overrides the on-disk filesystem format of the resulting
+	// config disk (e.g. "vfat"). Defaults to ISO9660 when empty.
+	// +optional
+	Format string `json:"format,omitempty"`
+	// DatasourceLayout overrides where on that filesystem cloud-init (or
+	// an equivalent datasource) expects to find the files. Defaults to
+	// the generic graft-point layout when empty.
+	// +optional
+	DatasourceLayout string `json:"datasourceLayout,omitempty"`
+}
+
+// SecretVolumeSource adapts a Secret into a volume, attached as a config
+// disk.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type SecretVolumeSource struct {
+	SecretName string `json:"secretName,omitempty"`
+	// LiveUpdate opts this volume into live reconciliation: the config
+	// disk is rebuilt and hot-swapped whenever the backing Secret
+	// changes, instead of only being built once at VMI startup.
+	// +optional
+	LiveUpdate bool `json:"liveUpdate,omitempty"`
+	// Format overrides the on-disk filesystem format of the resulting
+	// config disk (e.g. "vfat"). Defaults to ISO9660 when empty.
+	// +optional
+	Format string `json:"format,omitempty"`
+	// DatasourceLayout overrides where on that filesystem cloud-init (or
+	// an equivalent datasource) expects to find the files. Defaults to
+	// the generic graft-point layout when empty.
+	// +optional
+	DatasourceLayout string `json:"datasourceLayout,omitempty"`
+}
+
+// ProjectedVolumeSource merges the contents of several other volume sources
+// into a single directory/disk, mirroring Kubernetes' own projected volume.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type ProjectedVolumeSource struct {
+	Sources []VolumeProjection `json:"sources,omitempty"`
+}
+
+// VolumeProjection is one of the sources merged into a ProjectedVolumeSource.
+// Only one of its members may be specified.
+// +k8s:deepcopy-gen=true
+// +k8s:openapi-gen=true
+type VolumeProjection struct {
+	ConfigMap *ConfigMapVolumeSource `json:"configMap,omitempty"`
+	Secret    *SecretVolumeSource    `json:"secret,omitempty"`
+}